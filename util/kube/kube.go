@@ -13,11 +13,77 @@ import (
 
 var resourceNamePattern = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
 
+// listWildcard marks a ResourcePath segment whose value is a list. When encountered, the
+// remaining path is applied to every map element of that list rather than to the list itself.
+const listWildcard = "[]"
+
 // IsValidResourceName returns true if given string a valid Kubernetes resource name
 func IsValidResourceName(name string) bool {
 	return len(name) < 64 && resourceNamePattern.MatchString(name)
 }
 
+// ResourcePath identifies a location where labels should be propagated within a resource of a
+// given GroupVersionKind. Group, Version and Kind act as wildcards when left empty, so an entry
+// such as {Kind: "CronJob"} matches CronJobs in any API group/version.
+//
+// Path addresses the map that labels are merged into (e.g. the metadata.labels of a pod
+// template), not the individual label key. A "[]" segment indicates that the preceding field is
+// a list, and the remaining path is applied to each of its elements (e.g. StatefulSet's
+// volumeClaimTemplates).
+type ResourcePath struct {
+	Group   string
+	Version string
+	Kind    string
+	Path    []string
+}
+
+// Matches returns true if the path's Group/Version/Kind selector matches gvk. Empty selector
+// fields are treated as wildcards.
+func (p ResourcePath) Matches(gvk schema.GroupVersionKind) bool {
+	return (p.Group == "" || p.Group == gvk.Group) &&
+		(p.Version == "" || p.Version == gvk.Version) &&
+		(p.Kind == "" || p.Kind == gvk.Kind)
+}
+
+// CommonLabelPaths is the registry of well-known locations, across core workload kinds, where
+// the recommended app.kubernetes.io labels should be propagated in addition to the top-level
+// metadata.labels. It is modelled on kustomize's commonlabels.go transformer config.
+//
+// The registry is a package-level var, not a const, so entries for CRDs Argo CD doesn't know
+// about out of the box (e.g. Argo Rollouts, SparkApplications) can be appended in code, e.g. from
+// an init function in a custom build. Nothing in this package loads entries from a config map.
+var CommonLabelPaths = []ResourcePath{
+	{Group: "apps", Kind: kube.DeploymentKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "apps", Kind: kube.ReplicaSetKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "apps", Kind: kube.StatefulSetKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "apps", Kind: kube.StatefulSetKind, Path: []string{"spec", "volumeClaimTemplates", listWildcard, "metadata", "labels"}},
+	{Group: "apps", Kind: kube.DaemonSetKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "extensions", Kind: kube.DeploymentKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "extensions", Kind: kube.ReplicaSetKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "extensions", Kind: kube.DaemonSetKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "batch", Kind: kube.JobKind, Path: []string{"spec", "template", "metadata", "labels"}},
+	{Group: "batch", Kind: "CronJob", Path: []string{"spec", "jobTemplate", "metadata", "labels"}},
+	{Group: "batch", Kind: "CronJob", Path: []string{"spec", "jobTemplate", "spec", "template", "metadata", "labels"}},
+}
+
+// SelectorLabelPaths is a registry of locations, shaped like CommonLabelPaths, where a matching
+// label key narrows a *selector* rather than tagging a pod template: NetworkPolicy's podSelector
+// and PodDisruptionBudget's selector. Unlike CommonLabelPaths, this registry is deliberately kept
+// separate and is never consulted by SetAppInstanceLabel, SetAppInstanceLabels or
+// ApplyExtraLabels/ApplyExtraAnnotations.
+//
+// Folding these into CommonLabelPaths would mean every label Argo CD stamps onto a pod template
+// (including recommended labels that change on every sync, like app.kubernetes.io/version) also
+// shrinks the set of pods a NetworkPolicy allows or a PodDisruptionBudget protects - e.g. turning
+// a default-deny `podSelector: {}` into "only pods carrying this label", silently narrowing
+// network isolation. kustomize draws the same line between selector-bearing commonLabels and
+// plain labels for this reason. Callers that explicitly want selector-aware propagation (none do
+// yet) should opt in by consulting this registry themselves.
+var SelectorLabelPaths = []ResourcePath{
+	{Group: "networking.k8s.io", Kind: "NetworkPolicy", Path: []string{"spec", "podSelector", "matchLabels"}},
+	{Group: "policy", Kind: "PodDisruptionBudget", Path: []string{"spec", "selector", "matchLabels"}},
+}
+
 // SetAppInstanceLabel the recommended app.kubernetes.io/instance label against an unstructured object
 // Uses the legacy labeling if environment variable is set
 func SetAppInstanceLabel(target *unstructured.Unstructured, key, val string) error {
@@ -35,65 +101,392 @@ func SetAppInstanceLabel(target *unstructured.Unstructured, key, val string) err
 		return nil
 	}
 
-	gvk := schema.FromAPIVersionAndKind(target.GetAPIVersion(), target.GetKind())
-	// special case for deployment and job types: make sure that derived replicaset, and pod has
-	// the application label
-	switch gvk.Group {
-	case "apps", "extensions":
-		switch gvk.Kind {
-		case kube.DeploymentKind, kube.ReplicaSetKind, kube.StatefulSetKind, kube.DaemonSetKind:
-			templateLabels, ok, err := unstructured.NestedMap(target.UnstructuredContent(), "spec", "template", "metadata", "labels")
-			if err != nil {
+	// special case for deployment and job types, and the CRDs registered in CommonLabelPaths:
+	// make sure that derived replicasets, pods, jobTemplates and volume claim templates also
+	// carry the application label. Selector-bearing fields (NetworkPolicy/PDB) are deliberately
+	// not touched here - see SelectorLabelPaths.
+	gvk := target.GroupVersionKind()
+	for _, p := range CommonLabelPaths {
+		if !p.Matches(gvk) {
+			continue
+		}
+		if err := setNestedLabel(target.Object, p.Path, key, val); err != nil {
+			return fmt.Errorf("failed to set label at %v on %s %s/%s: %w", p.Path, gvk.String(), target.GetNamespace(), target.GetName(), err)
+		}
+	}
+
+	return defaultMatchLabelsWorkaround(target, key)
+}
+
+// setNestedLabel sets obj[path...][key] = val, creating any intermediate maps as needed. A
+// listWildcard segment in path is resolved against the list found at the preceding segments, and
+// the remaining path is applied to each of its map elements in place.
+func setNestedLabel(obj map[string]any, path []string, key, val string) error {
+	for i, segment := range path {
+		if segment != listWildcard {
+			continue
+		}
+		items, found, err := unstructured.NestedFieldNoCopy(obj, path[:i]...)
+		if err != nil {
+			return err
+		}
+		if !found || items == nil {
+			return nil
+		}
+		list, ok := items.([]any)
+		if !ok {
+			return fmt.Errorf("expected %v to be a list, got %T", path[:i], items)
+		}
+		for _, item := range list {
+			m, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			if err := setNestedLabel(m, path[i+1:], key, val); err != nil {
 				return err
 			}
-			if !ok || templateLabels == nil {
-				templateLabels = make(map[string]any)
+		}
+		return nil
+	}
+	return unstructured.SetNestedField(obj, val, append(append([]string{}, path...), key)...)
+}
+
+// defaultMatchLabelsWorkaround is a workaround for issue #335. In API version extensions/v1beta1
+// or apps/v1beta1, if a spec omits spec.selector then k8s will default the
+// spec.selector.matchLabels to match spec.template.metadata.labels. This means Argo CD labels can
+// potentially make their way into spec.selector.matchLabels, which is a bad thing. The following
+// logic prevents this behavior by explicitly setting spec.selector.matchLabels to the pod
+// template labels minus the keys Argo CD just injected.
+func defaultMatchLabelsWorkaround(target *unstructured.Unstructured, keys ...string) error {
+	switch target.GetAPIVersion() {
+	case "apps/v1beta1", "extensions/v1beta1":
+	default:
+		return nil
+	}
+	selector, _, err := unstructured.NestedMap(target.UnstructuredContent(), "spec", "selector")
+	if err != nil {
+		return err
+	}
+	if len(selector) != 0 {
+		// user already set spec.selector, nothing to default
+		return nil
+	}
+	templateLabels, ok, err := unstructured.NestedMap(target.UnstructuredContent(), "spec", "template", "metadata", "labels")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// no pod template on this resource (e.g. an Ingress at one of the above apiVersions) -
+		// there is nothing to default spec.selector.matchLabels from, so leave it untouched.
+		return nil
+	}
+	if templateLabels == nil {
+		templateLabels = make(map[string]any)
+	}
+	// If we get here, user did not set spec.selector in their manifest. We do not want our
+	// Argo CD labels to get defaulted by kubernetes, so we explicitly set the labels for them
+	// (minus the Argo CD labels).
+	for _, key := range keys {
+		delete(templateLabels, key)
+	}
+	return unstructured.SetNestedMap(target.UnstructuredContent(), templateLabels, "spec", "selector", "matchLabels")
+}
+
+// Recommended app.kubernetes.io label keys, as defined by
+// https://kubernetes.io/docs/concepts/overview/working-with-objects/common-labels/
+const (
+	RecommendedLabelKeyName      = "app.kubernetes.io/name"
+	RecommendedLabelKeyInstance  = "app.kubernetes.io/instance"
+	RecommendedLabelKeyPartOf    = "app.kubernetes.io/part-of"
+	RecommendedLabelKeyComponent = "app.kubernetes.io/component"
+	RecommendedLabelKeyManagedBy = "app.kubernetes.io/managed-by"
+	RecommendedLabelKeyVersion   = "app.kubernetes.io/version"
+)
+
+// PodTemplatePropagatingLabelKeys is the set of recommended label keys that SetAppInstanceLabels
+// propagates into pod templates, in addition to the top-level metadata.labels. SetAppInstanceLabel
+// propagates only the legacy common.LabelKeyLegacyApplicationName label this way; name, part-of,
+// component, managed-by and version are listed here, while instance is excluded by default, just
+// as SetAppInstanceLabel sets it on metadata.labels only.
+//
+// This is a package-level var, like CommonLabelPaths, so callers can opt individual keys in or
+// out (e.g. from a settings knob) without forking the function.
+var PodTemplatePropagatingLabelKeys = map[string]bool{
+	RecommendedLabelKeyName:      true,
+	RecommendedLabelKeyPartOf:    true,
+	RecommendedLabelKeyComponent: true,
+	RecommendedLabelKeyManagedBy: true,
+	RecommendedLabelKeyVersion:   true,
+}
+
+// SetAppInstanceLabels merges the given recommended app.kubernetes.io labels into the target's
+// metadata.labels in a single pass, and propagates the subset of keys listed in
+// PodTemplatePropagatingLabelKeys to every pod template location registered in CommonLabelPaths.
+// Unlike calling SetAppInstanceLabel once per key, which propagates only the legacy
+// common.LabelKeyLegacyApplicationName label, it propagates every listed recommended key. Which
+// labels are stamped is decided by the caller's labels map; this function reads no setting.
+//
+// Because it shares CommonLabelPaths with SetAppInstanceLabel, it never writes into
+// selector-bearing fields such as NetworkPolicy's podSelector or a PodDisruptionBudget's
+// selector - see SelectorLabelPaths. Like SetAppInstanceLabel, it also applies
+// defaultMatchLabelsWorkaround for every key it propagates into a pod template, so apps/v1beta1
+// and extensions/v1beta1 workloads that omit spec.selector don't leak these labels into the
+// kube-defaulted (and immutable) spec.selector.matchLabels.
+func SetAppInstanceLabels(target *unstructured.Unstructured, labels map[string]string) error {
+	existing, err := nestedNullableStringMap(target.Object, "metadata", "labels")
+	if err != nil {
+		return fmt.Errorf("failed to get labels from target object %s %s/%s: %w", target.GroupVersionKind().String(), target.GetNamespace(), target.GetName(), err)
+	}
+	if existing == nil {
+		existing = make(map[string]string)
+	}
+	for key, val := range labels {
+		existing[key] = val
+	}
+	target.SetLabels(existing)
+
+	gvk := target.GroupVersionKind()
+	var propagatedKeys []string
+	for key, val := range labels {
+		if !PodTemplatePropagatingLabelKeys[key] {
+			continue
+		}
+		for _, p := range CommonLabelPaths {
+			if !p.Matches(gvk) {
+				continue
+			}
+			if err := setNestedLabel(target.Object, p.Path, key, val); err != nil {
+				return fmt.Errorf("failed to set label at %v on %s %s/%s: %w", p.Path, gvk.String(), target.GetNamespace(), target.GetName(), err)
 			}
-			templateLabels[key] = val
-			err = unstructured.SetNestedMap(target.UnstructuredContent(), templateLabels, "spec", "template", "metadata", "labels")
-			if err != nil {
+		}
+		propagatedKeys = append(propagatedKeys, key)
+	}
+	if len(propagatedKeys) == 0 {
+		return nil
+	}
+	// Same issue-#335 protection SetAppInstanceLabel applies: strip every key we just propagated
+	// into spec.template.metadata.labels back out of the kube-defaulted spec.selector.matchLabels.
+	return defaultMatchLabelsWorkaround(target, propagatedKeys...)
+}
+
+// maxPodTemplateWalkDepth bounds the recursive descent performed by InjectIntoPodTemplates so
+// that unexpectedly deep manifests cannot turn it into unbounded work.
+const maxPodTemplateWalkDepth = 8
+
+// TrackPodsAnnotationKey is a resource customization annotation that opts a resource into the
+// generic pod template walk performed by InjectIntoPodTemplates. It is used for CRDs whose
+// embedded PodTemplateSpec isn't covered by CommonLabelPaths (e.g. Argo Rollouts, Knative
+// Services, KubeVirt VirtualMachines, Tekton TaskRuns).
+const TrackPodsAnnotationKey = "argocd.argoproj.io/track-pods"
+
+// podTemplateWalkSkipFields are field names that InjectIntoPodTemplates never descends into,
+// because they cannot contain a pod template (status) or because a map found there merely
+// resembles one by coincidence (spec.selector).
+var podTemplateWalkSkipFields = map[string]bool{
+	"status":   true,
+	"selector": true,
+}
+
+// InjectIntoPodTemplates recursively walks un's Object map and, for every sub-map shaped like a
+// PodTemplateSpec (a "metadata" sibling next to a "spec" with a non-empty "containers" list),
+// merges labels into its metadata.labels and annotations into its metadata.annotations.
+//
+// This supports tracking-by-label for workload-like CRDs that embed a pod template at a
+// non-standard path instead of the conventional spec.template. The walk only runs when un carries
+// the TrackPodsAnnotationKey resource customization set to "true"; otherwise this is a no-op, so
+// an unbounded walk can't mutate nested maps that merely resemble a pod template by coincidence
+// on a resource that never opted in.
+func InjectIntoPodTemplates(un *unstructured.Unstructured, labels, annotations map[string]string) error {
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+	if un.GetAnnotations()[TrackPodsAnnotationKey] != "true" {
+		return nil
+	}
+	return injectIntoPodTemplates(un.Object, labels, annotations, 0)
+}
+
+func injectIntoPodTemplates(obj map[string]any, labels, annotations map[string]string, depth int) error {
+	if depth > maxPodTemplateWalkDepth {
+		return nil
+	}
+	if isPodTemplateSpec(obj) {
+		if err := mergeNestedStringMap(obj, labels, "metadata", "labels"); err != nil {
+			return err
+		}
+		if err := mergeNestedStringMap(obj, annotations, "metadata", "annotations"); err != nil {
+			return err
+		}
+	}
+	for field, value := range obj {
+		if podTemplateWalkSkipFields[field] {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if err := injectIntoPodTemplates(v, labels, annotations, depth+1); err != nil {
 				return err
 			}
-			// The following is a workaround for issue #335. In API version extensions/v1beta1 or
-			// apps/v1beta1, if a spec omits spec.selector then k8s will default the
-			// spec.selector.matchLabels to match spec.template.metadata.labels. This means Argo CD
-			// labels can potentially make their way into spec.selector.matchLabels, which is a bad
-			// thing. The following logic prevents this behavior.
-			switch target.GetAPIVersion() {
-			case "apps/v1beta1", "extensions/v1beta1":
-				selector, _, err := unstructured.NestedMap(target.UnstructuredContent(), "spec", "selector")
-				if err != nil {
-					return err
-				}
-				if len(selector) == 0 {
-					// If we get here, user did not set spec.selector in their manifest. We do not want
-					// our Argo CD labels to get defaulted by kubernetes, so we explicitly set the labels
-					// for them (minus the Argo CD labels).
-					delete(templateLabels, key)
-					err = unstructured.SetNestedMap(target.UnstructuredContent(), templateLabels, "spec", "selector", "matchLabels")
-					if err != nil {
+		case []any:
+			for _, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					if err := injectIntoPodTemplates(m, labels, annotations, depth+1); err != nil {
 						return err
 					}
 				}
 			}
 		}
-	case "batch":
-		if gvk.Kind == kube.JobKind {
-			templateLabels, ok, err := unstructured.NestedMap(target.UnstructuredContent(), "spec", "template", "metadata", "labels")
-			if err != nil {
-				return err
+	}
+	return nil
+}
+
+// isPodTemplateSpec reports whether obj looks like a PodTemplateSpec: a "metadata" map alongside
+// a "spec" map that has a non-empty "containers" list.
+func isPodTemplateSpec(obj map[string]any) bool {
+	if _, ok := obj["metadata"].(map[string]any); !ok {
+		return false
+	}
+	spec, ok := obj["spec"].(map[string]any)
+	if !ok {
+		return false
+	}
+	containers, ok := spec["containers"].([]any)
+	return ok && len(containers) > 0
+}
+
+// mergeNestedStringMap merges extra into the string map found at path within obj, creating it if
+// necessary. A nil/empty extra is a no-op.
+func mergeNestedStringMap(obj map[string]any, extra map[string]string, path ...string) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	existing, _, err := unstructured.NestedStringMap(obj, path...)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		existing = make(map[string]string, len(extra))
+	}
+	for k, v := range extra {
+		existing[k] = v
+	}
+	return unstructured.SetNestedStringMap(obj, existing, path...)
+}
+
+// PropagationPolicy controls how far user-defined extra labels/annotations (e.g. configured via
+// argocd-cm, or an Application's syncPolicy) are propagated by ApplyExtraLabels and
+// ApplyExtraAnnotations.
+type PropagationPolicy string
+
+const (
+	// TopLevelOnly applies extra labels/annotations to the target's own metadata only.
+	TopLevelOnly PropagationPolicy = "TopLevelOnly"
+	// IncludePodTemplate additionally propagates to the pod template locations registered in
+	// CommonLabelPaths (spec.template, StatefulSet volumeClaimTemplates, CronJob jobTemplate, ...).
+	IncludePodTemplate PropagationPolicy = "IncludePodTemplate"
+	// IncludeAll additionally walks arbitrary embedded PodTemplateSpecs via InjectIntoPodTemplates,
+	// for CRDs not covered by CommonLabelPaths.
+	IncludeAll PropagationPolicy = "IncludeAll"
+)
+
+// ApplyExtraLabels merges extra into target's metadata.labels and, depending on policy,
+// propagates them into nested pod templates. It stamps extra labels (e.g. cost-center, team, env)
+// onto the given target and, optionally, its pods; nothing in this package calls it, so which
+// resources receive which labels is up to the caller.
+//
+// Because IncludePodTemplate/IncludeAll propagation is driven by CommonLabelPaths (and,
+// transitively, InjectIntoPodTemplates), extra labels/annotations never narrow a selector such as
+// a NetworkPolicy's podSelector or a PodDisruptionBudget's selector - those live in
+// SelectorLabelPaths, which this function does not consult.
+func ApplyExtraLabels(target *unstructured.Unstructured, extra map[string]string, policy PropagationPolicy) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	existing, err := nestedNullableStringMap(target.Object, "metadata", "labels")
+	if err != nil {
+		return fmt.Errorf("failed to get labels from target object %s %s/%s: %w", target.GroupVersionKind().String(), target.GetNamespace(), target.GetName(), err)
+	}
+	if existing == nil {
+		existing = make(map[string]string)
+	}
+	for k, v := range extra {
+		existing[k] = v
+	}
+	target.SetLabels(existing)
+	return propagateExtra(target, extra, nil, policy)
+}
+
+// ApplyExtraAnnotations merges extra into target's metadata.annotations and, depending on
+// policy, propagates them into nested pod templates.
+func ApplyExtraAnnotations(target *unstructured.Unstructured, extra map[string]string, policy PropagationPolicy) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	existing, err := nestedNullableStringMap(target.Object, "metadata", "annotations")
+	if err != nil {
+		return fmt.Errorf("failed to get annotations from target object %s %s/%s: %w", target.GroupVersionKind().String(), target.GetNamespace(), target.GetName(), err)
+	}
+	if existing == nil {
+		existing = make(map[string]string)
+	}
+	for k, v := range extra {
+		existing[k] = v
+	}
+	target.SetAnnotations(existing)
+	return propagateExtra(target, nil, extra, policy)
+}
+
+// propagateExtra implements the pod-template propagation step shared by ApplyExtraLabels and
+// ApplyExtraAnnotations, honoring policy against the same CommonLabelPaths registry used by
+// SetAppInstanceLabel/SetAppInstanceLabels.
+func propagateExtra(target *unstructured.Unstructured, labels, annotations map[string]string, policy PropagationPolicy) error {
+	if policy == TopLevelOnly {
+		return nil
+	}
+
+	gvk := target.GroupVersionKind()
+	for key, val := range labels {
+		for _, p := range CommonLabelPaths {
+			if !p.Matches(gvk) {
+				continue
 			}
-			if !ok || templateLabels == nil {
-				templateLabels = make(map[string]any)
+			if err := setNestedLabel(target.Object, p.Path, key, val); err != nil {
+				return fmt.Errorf("failed to set label at %v on %s %s/%s: %w", p.Path, gvk.String(), target.GetNamespace(), target.GetName(), err)
 			}
-			templateLabels[key] = val
-			err = unstructured.SetNestedMap(target.UnstructuredContent(), templateLabels, "spec", "template", "metadata", "labels")
-			if err != nil {
-				return err
+		}
+	}
+	for key, val := range annotations {
+		for _, p := range CommonLabelPaths {
+			if !p.Matches(gvk) {
+				continue
+			}
+			path := annotationPath(p.Path)
+			if path == nil {
+				// entries ending in matchLabels (selectors) have no annotation equivalent
+				continue
+			}
+			if err := setNestedLabel(target.Object, path, key, val); err != nil {
+				return fmt.Errorf("failed to set annotation at %v on %s %s/%s: %w", path, gvk.String(), target.GetNamespace(), target.GetName(), err)
 			}
 		}
 	}
-	return nil
+
+	if policy != IncludeAll {
+		return nil
+	}
+	return InjectIntoPodTemplates(target, labels, annotations)
+}
+
+// annotationPath swaps the trailing "labels" segment of a CommonLabelPaths entry for
+// "annotations", since both maps live at the same nesting under metadata. It returns nil for
+// paths that don't end in "labels" (e.g. selector matchLabels, which have no annotation
+// equivalent).
+func annotationPath(path []string) []string {
+	if len(path) == 0 || path[len(path)-1] != "labels" {
+		return nil
+	}
+	out := append([]string{}, path[:len(path)-1]...)
+	return append(out, "annotations")
 }
 
 // SetAppInstanceAnnotation the recommended app.kubernetes.io/instance annotation against an unstructured object
@@ -0,0 +1,429 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/argoproj/argo-cd/v3/common"
+)
+
+func TestSetAppInstanceLabel_CronJob(t *testing.T) {
+	cronJob := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "CronJob",
+		"metadata":   map[string]any{"name": "my-cronjob"},
+		"spec": map[string]any{
+			"jobTemplate": map[string]any{
+				"spec": map[string]any{
+					"template": map[string]any{},
+				},
+			},
+		},
+	}}
+
+	err := SetAppInstanceLabel(cronJob, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+
+	jobTemplateLabels, ok, err := unstructured.NestedStringMap(cronJob.Object, "spec", "jobTemplate", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "my-app", jobTemplateLabels[common.LabelKeyLegacyApplicationName])
+
+	podTemplateLabels, ok, err := unstructured.NestedStringMap(cronJob.Object, "spec", "jobTemplate", "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "my-app", podTemplateLabels[common.LabelKeyLegacyApplicationName])
+}
+
+func TestSetAppInstanceLabel_StatefulSetVolumeClaimTemplates(t *testing.T) {
+	statefulSet := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "StatefulSet",
+		"metadata":   map[string]any{"name": "my-statefulset"},
+		"spec": map[string]any{
+			"template": map[string]any{},
+			"volumeClaimTemplates": []any{
+				map[string]any{"metadata": map[string]any{"name": "data"}},
+				map[string]any{"metadata": map[string]any{"name": "logs"}},
+			},
+		},
+	}}
+
+	err := SetAppInstanceLabel(statefulSet, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+
+	templates, _, err := unstructured.NestedSlice(statefulSet.Object, "spec", "volumeClaimTemplates")
+	require.NoError(t, err)
+	require.Len(t, templates, 2)
+	for _, tmpl := range templates {
+		labels, ok, err := unstructured.NestedStringMap(tmpl.(map[string]any), "metadata", "labels")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "my-app", labels[common.LabelKeyLegacyApplicationName])
+	}
+}
+
+func TestSetAppInstanceLabels_PropagatesRecommendedKeysToPodTemplate(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "my-deployment"},
+		"spec": map[string]any{
+			"template": map[string]any{},
+		},
+	}}
+
+	err := SetAppInstanceLabels(deployment, map[string]string{
+		RecommendedLabelKeyName:     "my-app",
+		RecommendedLabelKeyInstance: "my-app-instance",
+		RecommendedLabelKeyPartOf:   "my-system",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "my-app", deployment.GetLabels()[RecommendedLabelKeyName])
+	assert.Equal(t, "my-app-instance", deployment.GetLabels()[RecommendedLabelKeyInstance])
+
+	templateLabels, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "my-app", templateLabels[RecommendedLabelKeyName])
+	assert.Equal(t, "my-system", templateLabels[RecommendedLabelKeyPartOf])
+	_, instancePropagated := templateLabels[RecommendedLabelKeyInstance]
+	assert.False(t, instancePropagated, "instance label should not propagate to pod template by default")
+}
+
+func TestSetAppInstanceLabels_DoesNotNarrowSelectors(t *testing.T) {
+	pdb := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "policy/v1",
+		"kind":       "PodDisruptionBudget",
+		"metadata":   map[string]any{"name": "my-pdb"},
+		"spec": map[string]any{
+			"selector": map[string]any{"matchLabels": map[string]any{"app": "my-app"}},
+		},
+	}}
+
+	err := SetAppInstanceLabels(pdb, map[string]string{
+		RecommendedLabelKeyName:    "my-app",
+		RecommendedLabelKeyVersion: "v1.2.3",
+	})
+	require.NoError(t, err)
+
+	matchLabels, ok, err := unstructured.NestedStringMap(pdb.Object, "spec", "selector", "matchLabels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"app": "my-app"}, matchLabels, "recommended labels must never narrow a PDB's selector")
+}
+
+func TestSetAppInstanceLabels_AppliesMatchLabelsWorkaroundForV1beta1(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "extensions/v1beta1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "my-deployment"},
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": map[string]any{"static": "label"}},
+			},
+		},
+	}}
+
+	err := SetAppInstanceLabels(deployment, map[string]string{
+		RecommendedLabelKeyName:   "my-app",
+		RecommendedLabelKeyPartOf: "my-system",
+	})
+	require.NoError(t, err)
+
+	templateLabels, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "my-app", templateLabels[RecommendedLabelKeyName])
+	assert.Equal(t, "my-system", templateLabels[RecommendedLabelKeyPartOf])
+
+	// kubernetes would otherwise default spec.selector.matchLabels to spec.template.metadata.labels
+	// verbatim; the workaround must strip the labels Argo CD just injected out of that default.
+	matchLabels, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "selector", "matchLabels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"static": "label"}, matchLabels)
+}
+
+func TestSetAppInstanceLabel_UserRegisteredCRD(t *testing.T) {
+	orig := CommonLabelPaths
+	defer func() { CommonLabelPaths = orig }()
+	CommonLabelPaths = append(CommonLabelPaths, ResourcePath{
+		Group: "argoproj.io",
+		Kind:  "Rollout",
+		Path:  []string{"spec", "template", "metadata", "labels"},
+	})
+
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]any{"name": "my-rollout"},
+		"spec": map[string]any{
+			"template": map[string]any{},
+		},
+	}}
+
+	err := SetAppInstanceLabel(rollout, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+
+	labels, ok, err := unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "my-app", labels[common.LabelKeyLegacyApplicationName])
+}
+
+func TestSetAppInstanceLabel_DoesNotNarrowSelectors(t *testing.T) {
+	networkPolicy := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata":   map[string]any{"name": "default-deny"},
+		"spec": map[string]any{
+			"podSelector": map[string]any{},
+		},
+	}}
+	err := SetAppInstanceLabel(networkPolicy, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+	_, ok, err := unstructured.NestedStringMap(networkPolicy.Object, "spec", "podSelector", "matchLabels")
+	require.NoError(t, err)
+	assert.False(t, ok, "SetAppInstanceLabel must not narrow a NetworkPolicy's podSelector")
+
+	pdb := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "policy/v1",
+		"kind":       "PodDisruptionBudget",
+		"metadata":   map[string]any{"name": "my-pdb"},
+		"spec": map[string]any{
+			"selector": map[string]any{"matchLabels": map[string]any{"app": "my-app"}},
+		},
+	}}
+	err = SetAppInstanceLabel(pdb, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+	matchLabels, ok, err := unstructured.NestedStringMap(pdb.Object, "spec", "selector", "matchLabels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, injected := matchLabels[common.LabelKeyLegacyApplicationName]
+	assert.False(t, injected, "SetAppInstanceLabel must not narrow a PodDisruptionBudget's selector")
+
+	// The paths still exist for callers that explicitly opt into selector-aware propagation.
+	require.Len(t, SelectorLabelPaths, 2)
+}
+
+func TestSetAppInstanceLabel_DoesNotSynthesizeSelectorOnTemplatelessV1beta1Resource(t *testing.T) {
+	ingress := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "extensions/v1beta1",
+		"kind":       "Ingress",
+		"metadata":   map[string]any{"name": "my-ingress"},
+		"spec": map[string]any{
+			"rules": []any{},
+		},
+	}}
+
+	err := SetAppInstanceLabel(ingress, common.LabelKeyLegacyApplicationName, "my-app")
+	require.NoError(t, err)
+
+	_, ok, err := unstructured.NestedMap(ingress.Object, "spec", "selector")
+	require.NoError(t, err)
+	assert.False(t, ok, "an Ingress has no pod template, so no spec.selector should be synthesized")
+}
+
+func podTemplate(name string) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{"name": name},
+		"spec": map[string]any{
+			"containers": []any{
+				map[string]any{"name": "main", "image": "busybox"},
+			},
+		},
+	}
+}
+
+func TestInjectIntoPodTemplates_Rollout(t *testing.T) {
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata": map[string]any{
+			"name":        "my-rollout",
+			"annotations": map[string]any{TrackPodsAnnotationKey: "true"},
+		},
+		"spec": map[string]any{"template": podTemplate("my-rollout")},
+	}}
+
+	err := InjectIntoPodTemplates(rollout, map[string]string{"team": "payments"}, map[string]string{"tracked-by": "argocd"})
+	require.NoError(t, err)
+
+	labels, ok, err := unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payments", labels["team"])
+
+	annotations, ok, err := unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "annotations")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "argocd", annotations["tracked-by"])
+}
+
+func TestInjectIntoPodTemplates_CronJob(t *testing.T) {
+	cronJob := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "batch/v1",
+		"kind":       "CronJob",
+		"metadata": map[string]any{
+			"name":        "my-cronjob",
+			"annotations": map[string]any{TrackPodsAnnotationKey: "true"},
+		},
+		"spec": map[string]any{
+			"jobTemplate": map[string]any{
+				"spec": map[string]any{
+					"template": podTemplate("my-cronjob"),
+				},
+			},
+		},
+	}}
+
+	err := InjectIntoPodTemplates(cronJob, map[string]string{"team": "payments"}, nil)
+	require.NoError(t, err)
+
+	labels, ok, err := unstructured.NestedStringMap(cronJob.Object, "spec", "jobTemplate", "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payments", labels["team"])
+}
+
+func TestInjectIntoPodTemplates_SyntheticCRD(t *testing.T) {
+	// A deeply-nested, non-standard location for the embedded pod template, as used by CRDs like
+	// KubeVirt VirtualMachines or Flink/Spark Applications.
+	synthetic := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "example.com/v1",
+		"kind":       "SyntheticWorkload",
+		"metadata": map[string]any{
+			"name":        "my-workload",
+			"annotations": map[string]any{TrackPodsAnnotationKey: "true"},
+		},
+		"spec": map[string]any{
+			"instanceTemplate": map[string]any{
+				"podSpecTemplate": podTemplate("my-workload"),
+			},
+		},
+		"status": map[string]any{
+			// should never be descended into or mutated
+			"podSpecTemplate": podTemplate("should-not-be-touched"),
+		},
+	}}
+
+	err := InjectIntoPodTemplates(synthetic, map[string]string{"team": "payments"}, nil)
+	require.NoError(t, err)
+
+	labels, ok, err := unstructured.NestedStringMap(synthetic.Object, "spec", "instanceTemplate", "podSpecTemplate", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payments", labels["team"])
+
+	_, ok, err = unstructured.NestedStringMap(synthetic.Object, "status", "podSpecTemplate", "metadata", "labels")
+	require.NoError(t, err)
+	assert.False(t, ok, "status subtree must not be touched")
+}
+
+func TestInjectIntoPodTemplates_RequiresOptInAnnotation(t *testing.T) {
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]any{"name": "my-rollout"},
+		"spec":       map[string]any{"template": podTemplate("my-rollout")},
+	}}
+
+	err := InjectIntoPodTemplates(rollout, map[string]string{"team": "payments"}, nil)
+	require.NoError(t, err)
+
+	_, ok, err := unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	assert.False(t, ok, "InjectIntoPodTemplates must not mutate a resource that did not opt in via TrackPodsAnnotationKey")
+
+	rollout.SetAnnotations(map[string]string{TrackPodsAnnotationKey: "false"})
+	err = InjectIntoPodTemplates(rollout, map[string]string{"team": "payments"}, nil)
+	require.NoError(t, err)
+	_, ok, err = unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	assert.False(t, ok, "any value other than the literal \"true\" must not opt in")
+}
+
+func TestApplyExtraLabels_TopLevelOnly(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "my-deployment"},
+		"spec":       map[string]any{"template": map[string]any{}},
+	}}
+
+	err := ApplyExtraLabels(deployment, map[string]string{"team": "payments"}, TopLevelOnly)
+	require.NoError(t, err)
+
+	assert.Equal(t, "payments", deployment.GetLabels()["team"])
+	_, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	assert.False(t, ok, "TopLevelOnly must not propagate to the pod template")
+}
+
+func TestApplyExtraLabelsAndAnnotations_IncludePodTemplate(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "my-deployment"},
+		"spec":       map[string]any{"template": map[string]any{}},
+	}}
+
+	require.NoError(t, ApplyExtraLabels(deployment, map[string]string{"team": "payments"}, IncludePodTemplate))
+	require.NoError(t, ApplyExtraAnnotations(deployment, map[string]string{"cost-center": "1234"}, IncludePodTemplate))
+
+	labels, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payments", labels["team"])
+
+	annotations, ok, err := unstructured.NestedStringMap(deployment.Object, "spec", "template", "metadata", "annotations")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "1234", annotations["cost-center"])
+}
+
+func TestApplyExtraLabels_IncludeAllReachesUnregisteredCRDTemplate(t *testing.T) {
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata": map[string]any{
+			"name":        "my-rollout",
+			"annotations": map[string]any{TrackPodsAnnotationKey: "true"},
+		},
+		"spec": map[string]any{"template": podTemplate("my-rollout")},
+	}}
+
+	err := ApplyExtraLabels(rollout, map[string]string{"team": "payments"}, IncludeAll)
+	require.NoError(t, err)
+
+	labels, ok, err := unstructured.NestedStringMap(rollout.Object, "spec", "template", "metadata", "labels")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "payments", labels["team"])
+}
+
+func TestApplyExtraLabels_DoesNotNarrowSelectors(t *testing.T) {
+	networkPolicy := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "NetworkPolicy",
+		"metadata":   map[string]any{"name": "default-deny"},
+		"spec": map[string]any{
+			"podSelector": map[string]any{},
+		},
+	}}
+
+	for _, policy := range []PropagationPolicy{TopLevelOnly, IncludePodTemplate, IncludeAll} {
+		require.NoError(t, ApplyExtraLabels(networkPolicy, map[string]string{"env": "prod"}, policy))
+		require.NoError(t, ApplyExtraAnnotations(networkPolicy, map[string]string{"team": "payments"}, policy))
+	}
+
+	assert.Equal(t, "prod", networkPolicy.GetLabels()["env"], "top-level labels still apply")
+	_, ok, err := unstructured.NestedStringMap(networkPolicy.Object, "spec", "podSelector", "matchLabels")
+	require.NoError(t, err)
+	assert.False(t, ok, "extra labels must never narrow a NetworkPolicy's podSelector, regardless of policy")
+}